@@ -0,0 +1,25 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import "testing"
+
+func TestArchiveFilename(t *testing.T) {
+	tests := []struct {
+		urlPath string
+		ext     string
+		want    string
+	}{
+		{"/", "zip", "root.zip"},
+		{"/docs", "zip", "docs.zip"},
+		{"/docs/", "tar.gz", "docs.tar.gz"},
+		{"/a/b/c", "zip", "c.zip"},
+	}
+	for _, tt := range tests {
+		if got := archiveFilename(tt.urlPath, tt.ext); got != tt.want {
+			t.Errorf("archiveFilename(%q, %q) = %q, want %q", tt.urlPath, tt.ext, got, tt.want)
+		}
+	}
+}
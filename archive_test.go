@@ -0,0 +1,48 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+	"testing/fstest"
+)
+
+func TestListArchiveFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/a.txt":        {Data: []byte("a")},
+		"dir/b.txt":        {Data: []byte("b")},
+		"dir/.hidden":      {Data: []byte("h")},
+		"dir/secret.txt":   {Data: []byte("s")},
+		"dir/sub/c.txt":    {Data: []byte("c")},
+		"dir/denied/d.txt": {Data: []byte("d")},
+	}
+
+	origHide, origDeny := hideRx, denyRx
+	hideRx = regexp.MustCompile(`/[.][^/]+$`)
+	denyRx = regexp.MustCompile(`/(secret\.txt|denied)(/|$)`)
+	t.Cleanup(func() { hideRx, denyRx = origHide, origDeny })
+
+	files, err := listArchiveFiles(fsys, "dir", "/dir")
+	if err != nil {
+		t.Fatalf("listArchiveFiles: %v", err)
+	}
+
+	var names []string
+	for _, af := range files {
+		names = append(names, af.name)
+	}
+	want := []string{"a.txt", "b.txt", "sub/c.txt"}
+	if !equalStrings(names, want) {
+		t.Errorf("listArchiveFiles names = %v, want %v (hidden and denied entries must be excluded)", names, want)
+	}
+
+	// The root of the archived subtree itself must not appear as an entry.
+	for _, af := range files {
+		if af.name == "." || af.name == "" {
+			t.Errorf("listArchiveFiles included the archived root itself: %+v", af)
+		}
+	}
+}
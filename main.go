@@ -5,36 +5,112 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html"
+	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
 	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"golang.org/x/image/draw"
 )
 
+// statusNoClientCert is reported when a certificate zone requires a client
+// certificate but none was presented. It is not defined by net/http, but
+// follows the convention popularized by nginx's "Certificate Required" code.
+const statusNoClientCert = 496
+
 var (
 	addr     = flag.String("addr", ":8080", "The network address to listen on.")
 	hide     = flag.String("hide", "/[.][^/]+(/|$)", "Regular expression of file paths to hide.\nPaths matching this pattern are excluded from directory listings,\nbut direct fetches for this path are still resolved.")
 	deny     = flag.String("deny", "", "Regular expression of file paths to deny.\nPaths matching this pattern are excluded from directory listings\nand direct fetches for this path report StatusForbidden.")
 	index    = flag.String("index", "", "Name of the index page to directly render for a directory.\n(e.g., 'index.html'; default none)")
-	root     = flag.String("root", ".", "Directory to serve files from.")
+	root     = flag.String("root", ".", "Directory to serve files from.\nIgnored if any -mount flags are given.")
 	sendfile = flag.Bool("sendfile", true, "Allow the use of the sendfile syscall.")
 	verbose  = flag.Bool("verbose", false, "Log every HTTP request.")
+	tmpl     = flag.String("template", "", "Path to a html/template file for rendering directory listings.\nThe template is executed with a dirListing value.\n(default: use the built-in template)")
+
+	tlsCert   = flag.String("tls-cert", "", "Path to a PEM-encoded TLS certificate.\n(default none; TLS is disabled)")
+	tlsKey    = flag.String("tls-key", "", "Path to the PEM-encoded TLS private key for -tls-cert.")
+	clientCA  = flag.String("client-ca", "", "Path to a PEM file of CA certificates for verifying client certificates.\n(default none; any client certificate is accepted at the TLS layer,\nleaving verification to -cert-zones)")
+	zonesFile = flag.String("cert-zones", "", "Path to a JSON file describing certificate zones:\n[{\"path\": <path regexp>, \"fingerprints\": [<sha256 hex>, ...]}, ...]\nRequests whose path matches a zone's regexp are only served when a\nclient certificate with an allowed fingerprint is presented.\n(requires -tls-cert and -tls-key; default none)")
+
+	gallery  = flag.Bool("gallery", false, "Render directories containing image/video/audio files as a media grid.")
+	cacheDir = flag.String("cache-dir", "", "Directory for caching generated thumbnails.\n(required to serve '?thumb=' requests under -gallery)")
+
+	cgiTimeout = flag.Duration("cgi-timeout", 30*time.Second, "Execution timeout for CGI scripts.")
+
+	mountFlags  mountList
+	cgiFlags    mountList
+	cgiEnvFlags mountList
+	cgiDirFlags mountList
 
-	hideRx *regexp.Regexp
-	denyRx *regexp.Regexp
+	hideRx    *regexp.Regexp
+	denyRx    *regexp.Regexp
+	dirTmpl   *template.Template
+	mounts    []mountPoint
+	certZones []certZone
+	cgiMounts []cgiMount
 )
 
+func init() {
+	flag.Var(&mountFlags, "mount", "Repeatable 'name=path' directory to mount under the URL prefix /name.\n(e.g., 'docs=/srv/docs'; if any -mount flags are given, -root is ignored)")
+	flag.Var(&cgiFlags, "cgi", "Repeatable 'prefix=script_root' directory of CGI scripts to execute\nfor requests under the URL prefix. (e.g., '/cgi-bin=/srv/scripts')")
+	flag.Var(&cgiEnvFlags, "cgi-env", "Repeatable 'prefix=VAR' environment variable to inherit from the host\nfor CGI scripts mounted at prefix. May be repeated per prefix.")
+	flag.Var(&cgiDirFlags, "cgi-dir", "Repeatable 'prefix=dir' working directory override for CGI scripts\nmounted at prefix.\n(default: the script's own directory)")
+}
+
+// mountPoint binds an fs.FS under a URL path prefix.
+// prefix is either "" (the root mount) or a cleaned, leading-slash,
+// no-trailing-slash path such as "/docs".
+type mountPoint struct {
+	prefix string
+	fsys   fs.FS
+}
+
+// mountList is a repeatable flag.Value collecting "name=path" arguments.
+type mountList []string
+
+func (m *mountList) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *mountList) Set(s string) error {
+	*m = append(*m, s)
+	return nil
+}
+
 func main() {
 	// Process command line flags.
 	var err error
@@ -69,15 +145,60 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
-	if _, err := os.Stat(*root); err != nil {
-		fmt.Fprintf(flag.CommandLine.Output(), "Invalid root directory: %v\n\n", err)
+	if mounts, err = buildMounts(*root, mountFlags); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "%v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *tmpl != "" {
+		dirTmpl, err = template.ParseFiles(*tmpl)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid template file: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintf(flag.CommandLine.Output(), "Both -tls-cert and -tls-key must be given together\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	var clientCAPool *x509.CertPool
+	if *clientCA != "" {
+		b, err := os.ReadFile(*clientCA)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid client CA file: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		clientCAPool = x509.NewCertPool()
+		if !clientCAPool.AppendCertsFromPEM(b) {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid client CA file: no certificates found\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if *zonesFile != "" {
+		if *tlsCert == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "-cert-zones requires -tls-cert and -tls-key\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		certZones, err = loadCertZones(*zonesFile)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid cert zones file: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if cgiMounts, err = buildCGIMounts(cgiFlags, cgiEnvFlags, cgiDirFlags); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "%v\n\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
 
 	// Startup the file server.
-	log.Printf("starting up server on %v", *addr)
-	log.Fatal(http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	server := &http.Server{Addr: *addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Never cache the server results. Consider it dynamically changing.
 		w.Header().Set("Cache-Control", "no-cache, no-store, no-transform, must-revalidate, private, max-age=0")
 
@@ -94,19 +215,50 @@ func main() {
 			log.Printf("%s %s", r.Method, r.URL.Path)
 		}
 
-		// Verify that the file exists.
-		fp := filepath.Join(*root, filepath.FromSlash(r.URL.Path))
-		fi, err := os.Stat(fp)
+		// Enforce certificate zones before any dispatch: a path matching a
+		// zone's regexp is only served when a client certificate with an
+		// allowed fingerprint was presented. This applies uniformly to CGI
+		// scripts and static files alike.
+		if zone, ok := matchCertZone(certZones, r.URL.Path); ok {
+			switch {
+			case r.TLS == nil || len(r.TLS.PeerCertificates) == 0:
+				http.Error(w, "496 Certificate Required: retry this request with a client certificate", statusNoClientCert)
+				return
+			case !zoneAllows(zone, r.TLS.PeerCertificates):
+				httpError(w, os.ErrPermission)
+				return
+			}
+		}
+
+		// Dispatch to a CGI script before the static-file branch, if the
+		// path falls under a configured -cgi prefix.
+		if m, ok := matchCGIMount(cgiMounts, r.URL.Path); ok {
+			if regexpMatch(denyRx, r.URL.Path) {
+				httpError(w, os.ErrPermission)
+				return
+			}
+			serveCGI(w, r, m)
+			return
+		}
+
+		// Resolve the request path to a mounted filesystem and verify
+		// that the file exists.
+		fsys, mountPrefix, name, ok := resolveMount(mounts, r.URL.Path)
+		if !ok {
+			httpError(w, os.ErrNotExist)
+			return
+		}
+		f, err := fsys.Open(name)
 		if err != nil {
 			httpError(w, err)
 			return
 		}
-		f, err := os.Open(fp)
+		defer f.Close()
+		fi, err := f.Stat()
 		if err != nil {
 			httpError(w, err)
 			return
 		}
-		defer f.Close()
 
 		// Check that there is a trailing slash for only directories.
 		if fi.IsDir() != strings.HasSuffix(r.URL.Path, "/") {
@@ -127,31 +279,398 @@ func main() {
 
 		// Serve either a directory or a file.
 		if fi.IsDir() {
-			serveDirectory(w, r, fp, f)
+			serveDirectory(w, r, fsys, name)
+		} else if thumbSize := r.URL.Query().Get("thumb"); *gallery && thumbSize != "" && mediaKind(name) == "image" {
+			serveThumbnail(w, r, fsys, mountPrefix, name, fi, thumbSize)
 		} else {
-			var rs io.ReadSeeker = f
+			rs, err := seekerFor(f)
+			if err != nil {
+				httpError(w, err)
+				return
+			}
 			if !*sendfile {
 				// Drop the ReadFrom method to avoid the use of sendfile syscall.
-				rs = struct{ io.ReadSeeker }{f}
+				rs = struct{ io.ReadSeeker }{rs}
 			}
-			http.ServeContent(w, r, fp, fi.ModTime(), rs)
+			http.ServeContent(w, r, name, fi.ModTime(), rs)
 		}
-	})))
+	})}
+	if clientCAPool != nil {
+		server.TLSConfig = &tls.Config{ClientCAs: clientCAPool, ClientAuth: tls.VerifyClientCertIfGiven}
+	} else if len(certZones) > 0 {
+		server.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+	}
+
+	log.Printf("starting up server on %v", *addr)
+	if *tlsCert != "" {
+		log.Fatal(server.ListenAndServeTLS(*tlsCert, *tlsKey))
+	} else {
+		log.Fatal(server.ListenAndServe())
+	}
 }
 
-func serveDirectory(w http.ResponseWriter, r *http.Request, fp string, f *os.File) {
+// buildMounts constructs the list of mount points from the -mount flags,
+// falling back to a single root mount backed by rootDir when none are given.
+// The returned mounts are ordered by decreasing prefix length so that
+// resolveMount finds the most specific match first.
+func buildMounts(rootDir string, specs []string) ([]mountPoint, error) {
+	if len(specs) == 0 {
+		if _, err := os.Stat(rootDir); err != nil {
+			return nil, fmt.Errorf("invalid root directory: %v", err)
+		}
+		return []mountPoint{{prefix: "", fsys: os.DirFS(rootDir)}}, nil
+	}
+
+	var mps []mountPoint
+	for _, spec := range specs {
+		name, dir, ok := strings.Cut(spec, "=")
+		if !ok || name == "" || dir == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid -mount %q: want name=path", spec)
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("invalid -mount %q: %v", spec, err)
+		}
+		mps = append(mps, mountPoint{prefix: "/" + name, fsys: os.DirFS(dir)})
+	}
+	sort.Slice(mps, func(i, j int) bool {
+		return len(mps[i].prefix) > len(mps[j].prefix)
+	})
+	return mps, nil
+}
+
+// resolveMount finds the mount whose prefix matches urlPath and returns
+// its fs.FS, that mount's prefix (to disambiguate content coming from
+// different mounts, e.g. for cache keys), and the name to open within
+// that filesystem (an fs.FS-style path: "." for the mount root, otherwise
+// slash-separated with no leading slash).
+func resolveMount(mounts []mountPoint, urlPath string) (fs.FS, string, string, bool) {
+	for _, m := range mounts {
+		if m.prefix == "" {
+			continue // the root mount is only used as a fallback, tried last
+		}
+		if urlPath == m.prefix || strings.HasPrefix(urlPath, m.prefix+"/") {
+			return m.fsys, m.prefix, fsName(strings.TrimPrefix(urlPath, m.prefix)), true
+		}
+	}
+	for _, m := range mounts {
+		if m.prefix == "" {
+			return m.fsys, m.prefix, fsName(urlPath), true
+		}
+	}
+	return nil, "", "", false
+}
+
+// fsName converts a cleaned URL path into an fs.FS-style name.
+func fsName(urlPath string) string {
+	urlPath = strings.Trim(urlPath, "/")
+	if urlPath == "" {
+		return "."
+	}
+	return urlPath
+}
+
+// cgiMount binds a directory of CGI scripts under a URL path prefix.
+type cgiMount struct {
+	prefix     string
+	scriptRoot string
+	dir        string   // working directory override, or "" for the script's own directory
+	inheritEnv []string // host environment variables the script may inherit
+}
+
+// buildCGIMounts constructs the list of CGI mounts from the -cgi, -cgi-env,
+// and -cgi-dir flags. It returns (nil, nil) if no -cgi flags were given.
+func buildCGIMounts(specs, envSpecs, dirSpecs []string) ([]cgiMount, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	envs := make(map[string][]string)
+	for _, spec := range envSpecs {
+		prefix, v, ok := strings.Cut(spec, "=")
+		if !ok || prefix == "" || v == "" {
+			return nil, fmt.Errorf("invalid -cgi-env %q: want prefix=VAR", spec)
+		}
+		prefix = "/" + strings.Trim(prefix, "/")
+		envs[prefix] = append(envs[prefix], v)
+	}
+	dirs := make(map[string]string)
+	for _, spec := range dirSpecs {
+		prefix, dir, ok := strings.Cut(spec, "=")
+		if !ok || prefix == "" || dir == "" {
+			return nil, fmt.Errorf("invalid -cgi-dir %q: want prefix=dir", spec)
+		}
+		dirs["/"+strings.Trim(prefix, "/")] = dir
+	}
+
+	var mps []cgiMount
+	for _, spec := range specs {
+		prefixRaw, scriptRoot, ok := strings.Cut(spec, "=")
+		if !ok || prefixRaw == "" || scriptRoot == "" {
+			return nil, fmt.Errorf("invalid -cgi %q: want prefix=script_root", spec)
+		}
+		if _, err := os.Stat(scriptRoot); err != nil {
+			return nil, fmt.Errorf("invalid -cgi %q: %v", spec, err)
+		}
+		prefix := "/" + strings.Trim(prefixRaw, "/")
+		mps = append(mps, cgiMount{
+			prefix:     prefix,
+			scriptRoot: scriptRoot,
+			dir:        dirs[prefix],
+			inheritEnv: envs[prefix],
+		})
+	}
+	sort.Slice(mps, func(i, j int) bool { return len(mps[i].prefix) > len(mps[j].prefix) })
+	return mps, nil
+}
+
+// matchCGIMount returns the CGI mount whose prefix matches urlPath, if any.
+func matchCGIMount(mounts []cgiMount, urlPath string) (cgiMount, bool) {
+	for _, m := range mounts {
+		if urlPath == m.prefix || strings.HasPrefix(urlPath, m.prefix+"/") {
+			return m, true
+		}
+	}
+	return cgiMount{}, false
+}
+
+// serveCGI resolves the script under m's script root for r.URL.Path and
+// executes it directly via os/exec, enforcing the -cgi-timeout execution
+// timeout.
+//
+// This deliberately does not use net/http/cgi.Handler: that package runs the
+// script with exec.Command and has no hook for killing it, so a hung script
+// outlives any timeout wrapped around the HTTP response (net/http.
+// TimeoutHandler only unblocks the client; it does not touch the child
+// process). Driving exec.CommandContext ourselves means the process is
+// killed the moment the timeout fires.
+func serveCGI(w http.ResponseWriter, r *http.Request, m cgiMount) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, m.prefix), "/")
+	scriptPath := filepath.Join(m.scriptRoot, filepath.FromSlash(rel))
+	if fi, err := os.Stat(scriptPath); err != nil || fi.IsDir() {
+		httpError(w, os.ErrNotExist)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), *cgiTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, scriptPath)
+	cmd.Dir = m.dir
+	if cmd.Dir == "" {
+		cmd.Dir = filepath.Dir(scriptPath)
+	}
+	cmd.Env = cgiEnviron(r, m, scriptPath)
+	cmd.Stdin = r.Body
+	cmd.Stderr = os.Stderr
+	// Run the script as the leader of its own process group, and on timeout
+	// kill the whole group rather than just cmd.Process: a script that forks
+	// children (e.g. a shell running another command) leaves them holding
+	// the stdout pipe open after the immediate child is killed, so the
+	// response body would never see EOF and the descendants would run on
+	// indefinitely.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	wroteHeader, err := writeCGIResponse(w, stdout)
+	if err != nil {
+		log.Printf("cgi %s: %v", scriptPath, err)
+	}
+
+	cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("cgi %s: killed after exceeding -cgi-timeout", scriptPath)
+		if !wroteHeader {
+			http.Error(w, "504 Gateway Timeout: CGI script took too long", http.StatusGatewayTimeout)
+		}
+	}
+}
+
+// cgiEnviron builds the CGI/1.1 environment for executing the script at
+// scriptPath on behalf of r, per m's mount configuration.
+func cgiEnviron(r *http.Request, m cgiMount, scriptPath string) []string {
+	remoteAddr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	contentLength := ""
+	if r.ContentLength >= 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	env := []string{
+		"SERVER_SOFTWARE=file-server",
+		"SERVER_PROTOCOL=" + r.Proto,
+		"SERVER_NAME=" + r.Host,
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"REQUEST_METHOD=" + r.Method,
+		"SCRIPT_NAME=" + m.prefix,
+		"PATH_INFO=" + strings.TrimPrefix(r.URL.Path, m.prefix),
+		"QUERY_STRING=" + r.URL.RawQuery,
+		"REMOTE_ADDR=" + remoteAddr,
+		"CONTENT_TYPE=" + r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH=" + contentLength,
+	}
+	for k, vv := range r.Header {
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		env = append(env, key+"="+strings.Join(vv, ", "))
+	}
+	for _, name := range m.inheritEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// writeCGIResponse reads a CGI/1.1 response (a MIME header block, optionally
+// starting with a "Status:" header, followed by the body) from stdout and
+// relays it to w. wroteHeader reports whether a status/header was committed
+// to w; it is false when the script exited (or was killed) before
+// producing any output at all, or when its header block could not be read
+// (err is then non-nil), leaving the caller free to write its own status
+// instead of falling through to the implicit 200 OK.
+func writeCGIResponse(w http.ResponseWriter, stdout io.Reader) (wroteHeader bool, err error) {
+	br := bufio.NewReader(stdout)
+	tp := textproto.NewReader(br)
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	if err == io.EOF && len(mimeHeader) == 0 {
+		return false, nil
+	}
+	header := http.Header(mimeHeader)
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		header.Del("Status")
+		if code, _, ok := strings.Cut(s, " "); ok {
+			if n, err := strconv.Atoi(code); err == nil {
+				status = n
+			}
+		}
+	}
+	for k, vv := range header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, br)
+	return true, err
+}
+
+// certZone protects a subtree matched by pathRx, allowing access only to
+// clients presenting a certificate whose SHA-256 fingerprint (hex-encoded)
+// appears in fingerprints.
+type certZone struct {
+	pathRx       *regexp.Regexp
+	fingerprints []string
+}
+
+// certZoneConfig is the on-disk (JSON) representation of a certZone.
+type certZoneConfig struct {
+	Path         string   `json:"path"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// loadCertZones reads and compiles the certificate zones described by the
+// JSON file at name.
+func loadCertZones(name string) ([]certZone, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var configs []certZoneConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, err
+	}
+	zones := make([]certZone, len(configs))
+	for i, c := range configs {
+		rx, err := regexp.Compile(c.Path)
+		if err != nil {
+			return nil, fmt.Errorf("zone %d: invalid path regexp %q: %v", i, c.Path, err)
+		}
+		zones[i] = certZone{pathRx: rx, fingerprints: c.Fingerprints}
+	}
+	return zones, nil
+}
+
+// matchCertZone returns the first zone whose path regexp matches urlPath.
+func matchCertZone(zones []certZone, urlPath string) (certZone, bool) {
+	for _, z := range zones {
+		if z.pathRx.MatchString(urlPath) {
+			return z, true
+		}
+	}
+	return certZone{}, false
+}
+
+// zoneAllows reports whether any of certs has a SHA-256 fingerprint that
+// appears (case-insensitively) in zone's allow-list.
+func zoneAllows(zone certZone, certs []*x509.Certificate) bool {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.Raw)
+		fp := hex.EncodeToString(sum[:])
+		for _, allowed := range zone.fingerprints {
+			if strings.EqualFold(fp, allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// seekerFor returns an io.ReadSeeker over f, which already satisfies the
+// interface for the common case of files backed by the OS filesystem
+// (e.g., via os.DirFS). Other fs.FS implementations (embed.FS, zip.Reader,
+// etc.) are not guaranteed to support seeking, so their contents are
+// buffered in memory.
+func seekerFor(f fs.File) (io.ReadSeeker, error) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+func serveDirectory(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) {
+	// Stream an archive of the subtree instead of a listing (if requested).
+	if archiveFormat := r.URL.Query().Get("archive"); archiveFormat != "" {
+		serveArchive(w, r, fsys, name, archiveFormat)
+		return
+	}
+
 	// Serve the index page directly (if possible).
 	if *index != "" {
-		fp2 := filepath.Join(fp, *index)
-		fi2, err := os.Stat(fp2)
+		name2 := path.Join(name, *index)
+		fi2, err := fs.Stat(fsys, name2)
 		if err == nil {
-			f2, err := os.Open(fp2)
+			f2, err := fsys.Open(name2)
 			if err != nil {
 				httpError(w, err)
 				return
 			}
 			defer f2.Close()
-			http.ServeContent(w, r, fp2, fi2.ModTime(), f2)
+			rs2, err := seekerFor(f2)
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+			http.ServeContent(w, r, name2, fi2.ModTime(), rs2)
 			return
 		} else if !os.IsNotExist(err) {
 			httpError(w, err)
@@ -159,23 +678,69 @@ func serveDirectory(w http.ResponseWriter, r *http.Request, fp string, f *os.Fil
 		}
 	}
 
-	// Read the directory entries, resolving any symbolic links,
-	// and sorting all the entries by name.
-	fis, err := f.Readdir(0)
+	// Read the directory entries, resolving any symbolic links.
+	ents, err := fs.ReadDir(fsys, name)
 	if err != nil {
 		httpError(w, err)
 		return
 	}
-	for i, fi := range fis {
-		if fi.Mode()*os.ModeSymlink > 0 {
-			if fi, _ := os.Stat(filepath.Join(fp, fi.Name())); fi != nil {
-				fis[i] = fi // best effort resolution
+	dirents := make([]dirEntry, 0, len(ents))
+	for _, ent := range ents {
+		childName := ent.Name()
+		urlPath := path.Join(r.URL.Path, childName)
+		if ent.IsDir() {
+			urlPath += "/"
+		}
+		if regexpMatch(hideRx, urlPath) || regexpMatch(denyRx, urlPath) {
+			continue
+		}
+		fi, err := ent.Info()
+		if err != nil {
+			continue
+		}
+		var symlink string
+		if fi.Mode()&os.ModeSymlink > 0 {
+			if f2, err := fsys.Open(path.Join(name, childName)); err == nil {
+				if osf, ok := f2.(*os.File); ok {
+					if target, err := os.Readlink(osf.Name()); err == nil {
+						symlink = target
+					}
+				}
+				if fi2, err := f2.Stat(); err == nil {
+					fi = fi2 // best effort resolution
+				}
+				f2.Close()
 			}
 		}
+		dirents = append(dirents, dirEntry{
+			Name:    childName,
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+			Symlink: symlink,
+		})
+	}
+
+	// Sort the entries according to the sort/order query parameters.
+	sortBy := r.URL.Query().Get("sort")
+	order := r.URL.Query().Get("order")
+	sortDirEntries(dirents, sortBy, order)
+
+	// Emit a structured JSON listing if requested.
+	if r.URL.Query().Get("format") == "json" || acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(dirents)
+		return
+	}
+
+	// Render the HTML listing, either from a user-supplied template
+	// or the built-in table.
+	if dirTmpl != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		dirTmpl.Execute(w, dirListing{Path: r.URL.Path, Sort: sortBy, Order: order, Entries: dirents})
+		return
 	}
-	sort.Slice(fis, func(i, j int) bool {
-		return fis[i].Name() < fis[j].Name()
-	})
 
 	// Format the header.
 	var bb bytes.Buffer
@@ -189,6 +754,10 @@ func serveDirectory(w http.ResponseWriter, r *http.Request, fp string, f *os.Fil
 	bb.WriteString("th, td { padding-right: 2em; }\n")
 	bb.WriteString("th { padding-bottom: 0.5em; }\n")
 	bb.WriteString("a, a:visited, a:hover, a:active { color: blue; }\n")
+	bb.WriteString(".gallery { display: flex; flex-wrap: wrap; gap: 1em; list-style: none; padding: 0; }\n")
+	bb.WriteString(".gallery figure { width: 256px; margin: 0; }\n")
+	bb.WriteString(".gallery img, .gallery video { max-width: 256px; max-height: 256px; }\n")
+	bb.WriteString(".gallery figcaption { overflow-wrap: break-word; }\n")
 	bb.WriteString("</style>\n")
 	bb.WriteString("</head>\n")
 	bb.WriteString("<body>\n")
@@ -207,49 +776,448 @@ func serveDirectory(w http.ResponseWriter, r *http.Request, fp string, f *os.Fil
 
 	bb.WriteString("<hr>\n")
 
-	// Format the list of files and folders.
+	// Format the list of files and folders, as a media grid if -gallery
+	// is enabled and the directory contains any media files.
+	hasMedia := false
+	if *gallery {
+		for _, de := range dirents {
+			if mediaKind(de.Name) != "" {
+				hasMedia = true
+				break
+			}
+		}
+	}
+	if hasMedia {
+		writeGallery(&bb, r, dirents)
+	} else {
+		writeDirectoryTable(&bb, r, dirents)
+	}
+
+	// Format the footer.
+	bb.WriteString("</body>\n")
+	bb.WriteString("</html>\n")
+	w.Write(bb.Bytes())
+}
+
+// writeDirectoryTable writes the plain sortable table of dirents to bb.
+func writeDirectoryTable(bb *bytes.Buffer, r *http.Request, dirents []dirEntry) {
 	bb.WriteString("<table>\n")
 	bb.WriteString("<thead>\n")
 	bb.WriteString("<tr>\n")
-	bb.WriteString("<th>Name</th>\n")
-	bb.WriteString("<th>Size</th>\n")
-	bb.WriteString("<th>Last Modified</th>\n")
+	bb.WriteString("<th>" + columnHeaderLink(r, "Name", "name") + "</th>\n")
+	bb.WriteString("<th>" + columnHeaderLink(r, "Size", "size") + "</th>\n")
+	bb.WriteString("<th>" + columnHeaderLink(r, "Last Modified", "mtime") + "</th>\n")
 	bb.WriteString("</tr>\n")
 	bb.WriteString("</thead>\n")
 	bb.WriteString("<tbody>\n")
 	now := time.Now()
-	for _, fi := range fis {
-		name := fi.Name()
-		urlPath := path.Join(r.URL.Path, name)
-		if fi.IsDir() {
+	for _, de := range dirents {
+		name := de.Name
+		if de.IsDir {
 			name += "/"
-			urlPath += "/"
 		}
 		urlString := (&url.URL{Path: name}).String()
-		if regexpMatch(hideRx, urlPath) || regexpMatch(denyRx, urlPath) {
-			continue
-		}
 		bb.WriteString("<tr>\n")
 		bb.WriteString("<td>")
 		bb.WriteString(`<a href="` + html.EscapeString(urlString) + `">` + html.EscapeString(name) + `</a>`)
 		bb.WriteString("</td>\n")
 		bb.WriteString("<td>")
-		if fi.Mode().IsRegular() {
-			bb.WriteString(html.EscapeString(formatSize(fi.Size())))
+		if de.Mode.IsRegular() {
+			bb.WriteString(html.EscapeString(formatSize(de.Size)))
 		}
 		bb.WriteString("</td>\n")
 		bb.WriteString("<td>")
-		bb.WriteString(html.EscapeString(formatTime(fi.ModTime(), now)))
+		bb.WriteString(html.EscapeString(formatTime(de.ModTime, now)))
 		bb.WriteString("</td>\n")
 		bb.WriteString("</tr>\n")
 	}
 	bb.WriteString("</tbody>\n")
 	bb.WriteString("</table>\n")
+}
 
-	// Format the footer.
-	bb.WriteString("</body>\n")
-	bb.WriteString("</html>\n")
-	w.Write(bb.Bytes())
+// writeGallery writes a thumbnail/media grid for the media files in
+// dirents, followed by a compact table of any remaining (non-media) files.
+func writeGallery(bb *bytes.Buffer, r *http.Request, dirents []dirEntry) {
+	var rest []dirEntry
+	bb.WriteString(`<ul class="gallery">` + "\n")
+	for _, de := range dirents {
+		kind := mediaKind(de.Name)
+		if kind == "" {
+			rest = append(rest, de)
+			continue
+		}
+		urlString := (&url.URL{Path: de.Name}).String()
+		bb.WriteString("<li><figure>\n")
+		switch kind {
+		case "image":
+			thumbURL := urlString + "?thumb=256"
+			bb.WriteString(`<a href="` + html.EscapeString(urlString) + `"><img src="` + html.EscapeString(thumbURL) + `" loading="lazy" alt=""></a>` + "\n")
+		case "video":
+			bb.WriteString(`<video controls preload="metadata" src="` + html.EscapeString(urlString) + `"></video>` + "\n")
+		case "audio":
+			bb.WriteString(`<audio controls preload="metadata" src="` + html.EscapeString(urlString) + `"></audio>` + "\n")
+		}
+		bb.WriteString(`<figcaption><a href="` + html.EscapeString(urlString) + `">` + html.EscapeString(de.Name) + `</a></figcaption>` + "\n")
+		bb.WriteString("</figure></li>\n")
+	}
+	bb.WriteString("</ul>\n")
+	if len(rest) > 0 {
+		bb.WriteString("<hr>\n")
+		writeDirectoryTable(bb, r, rest)
+	}
+}
+
+// mediaKind classifies name by extension into "image", "video", "audio",
+// or "" for anything else.
+func mediaKind(name string) string {
+	switch strings.ToLower(strings.TrimPrefix(path.Ext(name), ".")) {
+	case "jpg", "jpeg", "png", "gif", "webp", "avif":
+		return "image"
+	case "mp4", "webm", "mov":
+		return "video"
+	case "mp3", "ogg", "flac", "wav":
+		return "audio"
+	default:
+		return ""
+	}
+}
+
+// dirEntry describes a single file or directory within a listing,
+// both for the HTML table and the JSON encoding.
+type dirEntry struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	IsDir   bool        `json:"isDir"`
+	Symlink string      `json:"symlink,omitempty"`
+}
+
+// dirListing is the value passed to a user-supplied -template file.
+type dirListing struct {
+	Path    string
+	Sort    string
+	Order   string
+	Entries []dirEntry
+}
+
+// sortDirEntries sorts des in-place according to by ("name", "size", or "mtime")
+// and order ("asc" or "desc"), defaulting to an ascending sort by name.
+func sortDirEntries(des []dirEntry, by, order string) {
+	var less func(i, j int) bool
+	switch by {
+	case "size":
+		less = func(i, j int) bool { return des[i].Size < des[j].Size }
+	case "mtime":
+		less = func(i, j int) bool { return des[i].ModTime.Before(des[j].ModTime) }
+	default:
+		less = func(i, j int) bool { return des[i].Name < des[j].Name }
+	}
+	if order == "desc" {
+		orig := less
+		less = func(i, j int) bool { return orig(j, i) }
+	}
+	sort.SliceStable(des, less)
+}
+
+// acceptsJSON reports whether the client's Accept header lists
+// application/json at all; quality values are not considered.
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// columnHeaderLink renders a clickable column header for name that toggles
+// the sort order on column when clicked again.
+func columnHeaderLink(r *http.Request, name, column string) string {
+	order := "asc"
+	if r.URL.Query().Get("sort") == column && r.URL.Query().Get("order") != "desc" {
+		order = "desc"
+	}
+	q := url.Values{"sort": {column}, "order": {order}}
+	return `<a href="?` + q.Encode() + `">` + html.EscapeString(name) + `</a>`
+}
+
+// archiveFile is a single file to be written into an outgoing archive.
+type archiveFile struct {
+	fsPath string // path to open within fsys
+	name   string // slash-separated name to use within the archive
+}
+
+// serveArchive streams a deterministic zip or tar.gz archive of the
+// (non-hidden, non-denied) subtree rooted at name within fsys, cancelling
+// early if the client disconnects. format must be "zip" or "tar.gz"; any
+// other value is reported as a bad request.
+//
+// Unlike regular file serving (which goes through http.ServeContent), this
+// does not support HTTP Range or conditional requests (If-None-Match,
+// If-Modified-Since): the archive is built on the fly from a live directory
+// walk rather than served from a fixed, seekable, independently-hashable
+// resource, so there is no cheap byte range or representation identity to
+// validate a Range or conditional request against. Every request streams
+// the full archive from the start; Accept-Ranges: none tells clients not to
+// expect otherwise.
+func serveArchive(w http.ResponseWriter, r *http.Request, fsys fs.FS, name, format string) {
+	var ext string
+	switch format {
+	case "zip", "tar.gz":
+		ext = format
+	default:
+		http.Error(w, "400 Bad Request: unknown archive format", http.StatusBadRequest)
+		return
+	}
+
+	files, err := listArchiveFiles(fsys, name, r.URL.Path)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+archiveFilename(r.URL.Path, ext))
+	w.Header().Set("Accept-Ranges", "none")
+
+	switch format {
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		zw := zip.NewWriter(w)
+		defer zw.Close()
+		for _, af := range files {
+			if err := r.Context().Err(); err != nil {
+				return
+			}
+			if err := addFileToZip(zw, fsys, af); err != nil {
+				log.Printf("archive %v: %v", af.name, err)
+				return
+			}
+		}
+	case "tar.gz":
+		w.Header().Set("Content-Type", "application/gzip")
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+		tw := tar.NewWriter(gw)
+		defer tw.Close()
+		for _, af := range files {
+			if err := r.Context().Err(); err != nil {
+				return
+			}
+			if err := addFileToTar(tw, fsys, af); err != nil {
+				log.Printf("archive %v: %v", af.name, err)
+				return
+			}
+		}
+	}
+}
+
+// archiveFilename derives the "name.ext" filename to offer for an archive
+// of the directory at urlPath, falling back to "root.ext" for the server
+// root (where path.Base would otherwise yield "." or "/").
+func archiveFilename(urlPath, ext string) string {
+	base := path.Base(strings.TrimSuffix(urlPath, "/"))
+	if base == "" || base == "/" || base == "." {
+		base = "root"
+	}
+	return base + "." + ext
+}
+
+// listArchiveFiles walks the subtree rooted at name within fsys and returns
+// the regular files that pass the hide/deny filters, in a stable (lexically
+// sorted by archive name) order. urlPath is the request's URL path,
+// corresponding to name, and is used to evaluate hideRx/denyRx.
+func listArchiveFiles(fsys fs.FS, name, urlPath string) ([]archiveFile, error) {
+	var files []archiveFile
+	err := fs.WalkDir(fsys, name, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if walkPath == name {
+			return nil // the directory being archived itself
+		}
+		rel := walkPath
+		if name != "." {
+			rel = strings.TrimPrefix(walkPath, name+"/")
+		}
+		childURLPath := path.Join(urlPath, rel)
+		if d.IsDir() {
+			childURLPath += "/"
+		}
+		if regexpMatch(hideRx, childURLPath) || regexpMatch(denyRx, childURLPath) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, archiveFile{fsPath: walkPath, name: rel})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// addFileToZip writes af's file into zw.
+func addFileToZip(zw *zip.Writer, fsys fs.FS, af archiveFile) error {
+	fi, err := fs.Stat(fsys, af.fsPath)
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = af.name
+	hdr.Method = zip.Deflate
+	wc, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	f, err := fsys.Open(af.fsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(wc, f)
+	return err
+}
+
+// addFileToTar writes af's file into tw.
+func addFileToTar(tw *tar.Writer, fsys fs.FS, af archiveFile) error {
+	fi, err := fs.Stat(fsys, af.fsPath)
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = af.name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	f, err := fsys.Open(af.fsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// serveThumbnail serves a Catmull-Rom-scaled JPEG thumbnail of the image at
+// name within mountPrefix's filesystem, generating and caching it under
+// -cache-dir if not already present.
+func serveThumbnail(w http.ResponseWriter, r *http.Request, fsys fs.FS, mountPrefix, name string, fi fs.FileInfo, sizeParam string) {
+	size, err := strconv.Atoi(sizeParam)
+	if err != nil || size <= 0 || size > 4096 {
+		http.Error(w, "400 Bad Request: invalid thumb size", http.StatusBadRequest)
+		return
+	}
+	if *cacheDir == "" {
+		http.Error(w, "501 Not Implemented: thumbnails require -cache-dir", http.StatusNotImplemented)
+		return
+	}
+
+	cachePath := filepath.Join(*cacheDir, thumbCacheKey(mountPrefix, name, fi, size)+".jpg")
+	if cfi, err := os.Stat(cachePath); err == nil {
+		serveThumbFromCache(w, r, cachePath, cfi)
+		return
+	}
+
+	src, err := fsys.Open(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	img, _, err := image.Decode(src)
+	src.Close()
+	if err != nil {
+		http.Error(w, "400 Bad Request: unsupported or corrupt image", http.StatusBadRequest)
+		return
+	}
+	if err := writeThumbnailCache(cachePath, scaleThumbnail(img, size)); err != nil {
+		log.Printf("thumbnail %v: %v", name, err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	cfi, err := os.Stat(cachePath)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	serveThumbFromCache(w, r, cachePath, cfi)
+}
+
+// thumbCacheKey derives a stable cache filename from the owning mount, the
+// source path, its mtime and size, and the requested thumbnail size. The
+// mount prefix is included because two different mounts (and therefore two
+// different backing filesystems) can hold unrelated files that share the
+// same relative name, size, and mtime; without it they would collide on the
+// same cache entry and one mount's thumbnail would be served for the other's
+// file.
+func thumbCacheKey(mountPrefix, name string, fi fs.FileInfo, size int) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s|%s|%d|%d|%d", mountPrefix, name, fi.ModTime().UnixNano(), fi.Size(), size)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scaleThumbnail returns img scaled down (preserving aspect ratio) so that
+// its longest side is at most maxSize, using Catmull-Rom resampling.
+func scaleThumbnail(img image.Image, maxSize int) image.Image {
+	b := img.Bounds()
+	scale := 1.0
+	if s := float64(maxSize) / float64(b.Dx()); s < scale {
+		scale = s
+	}
+	if s := float64(maxSize) / float64(b.Dy()); s < scale {
+		scale = s
+	}
+	dw, dh := int(float64(b.Dx())*scale), int(float64(b.Dy())*scale)
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// writeThumbnailCache JPEG-encodes img to cachePath, writing to a temporary
+// file first so concurrent requests never observe a partial file.
+func writeThumbnailCache(cachePath string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), "thumb-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := jpeg.Encode(tmp, img, &jpeg.Options{Quality: 85}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cachePath)
+}
+
+// serveThumbFromCache serves the already-generated thumbnail at cachePath,
+// relying on http.ServeContent for conditional-request (ETag/Last-Modified)
+// handling.
+func serveThumbFromCache(w http.ResponseWriter, r *http.Request, cachePath string, cfi os.FileInfo) {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", `"`+filepath.Base(cachePath)+`"`)
+	http.ServeContent(w, r, cachePath, cfi.ModTime(), f)
 }
 
 func relativeRedirect(w http.ResponseWriter, r *http.Request, urlPath string) {
@@ -0,0 +1,143 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func fakeCert(raw string) *x509.Certificate {
+	return &x509.Certificate{Raw: []byte(raw)}
+}
+
+func fingerprintOf(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMatchCertZone(t *testing.T) {
+	zones := []certZone{
+		{pathRx: regexp.MustCompile(`^/admin(/|$)`), fingerprints: []string{"aaaa"}},
+		{pathRx: regexp.MustCompile(`^/secret(/|$)`), fingerprints: []string{"bbbb"}},
+	}
+
+	tests := []struct {
+		path    string
+		wantIdx int // index into zones, or -1 for no match
+	}{
+		{"/admin", 0},
+		{"/admin/", 0},
+		{"/admin/sub/path", 0},
+		{"/secret/file.txt", 1},
+		{"/public/file.txt", -1},
+		{"/administrator", -1}, // must not match on a bare prefix of "/admin"
+	}
+	for _, tt := range tests {
+		got, ok := matchCertZone(zones, tt.path)
+		if tt.wantIdx < 0 {
+			if ok {
+				t.Errorf("matchCertZone(%q) = %+v, true; want no match", tt.path, got)
+			}
+			continue
+		}
+		want := zones[tt.wantIdx]
+		if !ok || got.pathRx.String() != want.pathRx.String() {
+			t.Errorf("matchCertZone(%q) = %+v, %v; want %+v, true", tt.path, got, ok, want)
+		}
+	}
+}
+
+func TestZoneAllows(t *testing.T) {
+	zone := certZone{fingerprints: []string{
+		fingerprintOf("cert-a"),
+		strings.ToUpper(fingerprintOf("cert-b")), // exercise the case-insensitive compare
+	}}
+
+	tests := []struct {
+		name  string
+		certs []*x509.Certificate
+		want  bool
+	}{
+		{"allowed, lowercase fingerprint", []*x509.Certificate{fakeCert("cert-a")}, true},
+		{"allowed, differently-cased fingerprint", []*x509.Certificate{fakeCert("cert-b")}, true},
+		{"not allowed", []*x509.Certificate{fakeCert("cert-c")}, false},
+		{"no certs presented", nil, false},
+		{"one of several allowed", []*x509.Certificate{fakeCert("cert-c"), fakeCert("cert-a")}, true},
+	}
+	for _, tt := range tests {
+		if got := zoneAllows(zone, tt.certs); got != tt.want {
+			t.Errorf("%s: zoneAllows() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchCGIMount(t *testing.T) {
+	mounts := []cgiMount{
+		{prefix: "/cgi/sub", scriptRoot: "sub-root"},
+		{prefix: "/cgi", scriptRoot: "cgi-root"},
+	}
+
+	tests := []struct {
+		path        string
+		wantRoot    string
+		wantNoMatch bool
+	}{
+		{"/cgi", "cgi-root", false},
+		{"/cgi/hello.sh", "cgi-root", false},
+		{"/cgi/sub", "sub-root", false},
+		{"/cgi/sub/hello.sh", "sub-root", false},
+		{"/other", "", true},
+		{"/cgistuff", "", true}, // must not match on a bare prefix of "/cgi"
+	}
+	for _, tt := range tests {
+		m, ok := matchCGIMount(mounts, tt.path)
+		if tt.wantNoMatch {
+			if ok {
+				t.Errorf("matchCGIMount(%q) = %+v, true; want no match", tt.path, m)
+			}
+			continue
+		}
+		if !ok || m.scriptRoot != tt.wantRoot {
+			t.Errorf("matchCGIMount(%q) = %+v, %v; want scriptRoot %q, true", tt.path, m, ok, tt.wantRoot)
+		}
+	}
+}
+
+func TestBuildCGIMounts(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.Mkdir(tmp+"/scripts", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err := buildCGIMounts(
+		[]string{"cgi=" + tmp + "/scripts", "/cgi/api=" + tmp + "/scripts"},
+		[]string{"cgi=PATH"},
+		[]string{"cgi=" + tmp},
+	)
+	if err != nil {
+		t.Fatalf("buildCGIMounts: %v", err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("buildCGIMounts: got %d mounts, want 2", len(mounts))
+	}
+	// Longer prefixes must sort first so matchCGIMount prefers the most
+	// specific mount.
+	if mounts[0].prefix != "/cgi/api" {
+		t.Errorf("mounts[0].prefix = %q, want /cgi/api", mounts[0].prefix)
+	}
+	if got := mounts[1]; got.prefix != "/cgi" || got.dir != tmp || len(got.inheritEnv) != 1 || got.inheritEnv[0] != "PATH" {
+		t.Errorf("mounts[1] = %+v, want prefix /cgi, dir %q, inheritEnv [PATH]", got, tmp)
+	}
+
+	if _, err := buildCGIMounts([]string{"cgi=" + tmp + "/does-not-exist"}, nil, nil); err == nil {
+		t.Error("buildCGIMounts: expected error for a nonexistent script root, got nil")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildMounts(t *testing.T) {
+	tmpA := t.TempDir()
+	tmpB := t.TempDir()
+
+	mps, err := buildMounts("", []string{"b=" + tmpB, "alpha=" + tmpA})
+	if err != nil {
+		t.Fatalf("buildMounts: %v", err)
+	}
+	if len(mps) != 2 {
+		t.Fatalf("buildMounts: got %d mounts, want 2", len(mps))
+	}
+	// Longer prefixes must sort first so resolveMount prefers the most
+	// specific mount.
+	if mps[0].prefix != "/alpha" {
+		t.Errorf("mps[0].prefix = %q, want /alpha", mps[0].prefix)
+	}
+	if mps[1].prefix != "/b" {
+		t.Errorf("mps[1].prefix = %q, want /b", mps[1].prefix)
+	}
+
+	if _, err := buildMounts("", []string{"bad-spec"}); err == nil {
+		t.Error(`buildMounts(["bad-spec"]): expected error for a spec missing "=", got nil`)
+	}
+	if _, err := buildMounts("", []string{"name=" + tmpA + "/does-not-exist"}); err == nil {
+		t.Error("buildMounts: expected error for a nonexistent mount directory, got nil")
+	}
+
+	root := t.TempDir()
+	mps, err = buildMounts(root, nil)
+	if err != nil {
+		t.Fatalf("buildMounts(root, nil): %v", err)
+	}
+	if len(mps) != 1 || mps[0].prefix != "" {
+		t.Errorf("buildMounts(root, nil) = %+v, want a single mount with an empty prefix", mps)
+	}
+}
+
+func TestResolveMount(t *testing.T) {
+	tmpSub := t.TempDir()
+	mounts, err := buildMounts("", []string{"sub=" + tmpSub})
+	if err != nil {
+		t.Fatalf("buildMounts: %v", err)
+	}
+
+	tests := []struct {
+		path       string
+		wantPrefix string
+		wantName   string
+		wantOK     bool
+	}{
+		{"/sub", "/sub", ".", true},
+		{"/sub/", "/sub", ".", true},
+		{"/sub/file.txt", "/sub", "file.txt", true},
+		{"/other/file.txt", "", "", false},
+		{"/subsidiary/file.txt", "", "", false}, // must not match on a bare prefix of "/sub"
+	}
+	for _, tt := range tests {
+		fsys, prefix, name, ok := resolveMount(mounts, tt.path)
+		if ok != tt.wantOK {
+			t.Errorf("resolveMount(%q): ok = %v, want %v", tt.path, ok, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if fsys == nil {
+			t.Errorf("resolveMount(%q): fsys = nil", tt.path)
+		}
+		if prefix != tt.wantPrefix {
+			t.Errorf("resolveMount(%q): prefix = %q, want %q", tt.path, prefix, tt.wantPrefix)
+		}
+		if name != tt.wantName {
+			t.Errorf("resolveMount(%q): name = %q, want %q", tt.path, name, tt.wantName)
+		}
+	}
+
+	// With only a root mount (no -mount flags), every path resolves to it.
+	rootMounts, err := buildMounts(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("buildMounts(root, nil): %v", err)
+	}
+	if _, prefix, name, ok := resolveMount(rootMounts, "/any/path"); !ok || prefix != "" || name != "any/path" {
+		t.Errorf(`resolveMount(root-only, "/any/path") = _, %q, %q, %v; want "", "any/path", true`, prefix, name, ok)
+	}
+}
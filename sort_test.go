@@ -0,0 +1,60 @@
+// Copyright 2021, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSortDirEntries(t *testing.T) {
+	newEntries := func() []dirEntry {
+		return []dirEntry{
+			{Name: "banana", Size: 30, ModTime: time.Unix(300, 0)},
+			{Name: "apple", Size: 10, ModTime: time.Unix(100, 0)},
+			{Name: "cherry", Size: 20, ModTime: time.Unix(200, 0)},
+		}
+	}
+	names := func(des []dirEntry) []string {
+		names := make([]string, len(des))
+		for i, d := range des {
+			names[i] = d.Name
+		}
+		return names
+	}
+
+	tests := []struct {
+		by, order string
+		want      []string
+	}{
+		{"name", "asc", []string{"apple", "banana", "cherry"}},
+		{"name", "desc", []string{"cherry", "banana", "apple"}},
+		{"size", "asc", []string{"apple", "cherry", "banana"}},
+		{"size", "desc", []string{"banana", "cherry", "apple"}},
+		{"mtime", "asc", []string{"apple", "cherry", "banana"}},
+		{"mtime", "desc", []string{"banana", "cherry", "apple"}},
+		{"bogus", "asc", []string{"apple", "banana", "cherry"}}, // unknown "by" falls back to name
+	}
+	for _, tt := range tests {
+		des := newEntries()
+		sortDirEntries(des, tt.by, tt.order)
+		got := names(des)
+		if !equalStrings(got, tt.want) {
+			t.Errorf("sortDirEntries(by=%q, order=%q) = %v, want %v", tt.by, tt.order, got, tt.want)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}